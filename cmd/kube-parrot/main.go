@@ -0,0 +1,116 @@
+// Command kube-parrot announces Kubernetes Service externalIPs as BGP
+// routes via a local GoBGP speaker.
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/osrg/gobgp/server"
+	"github.com/sapcc/kube-parrot/pkg/bgp"
+	"github.com/sapcc/kube-parrot/pkg/controller"
+	"github.com/sapcc/kube-parrot/pkg/forked/informer"
+	"github.com/sapcc/kube-parrot/pkg/metrics"
+	"github.com/sapcc/kube-parrot/pkg/trace"
+	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/rest"
+	"k8s.io/client-go/1.5/tools/clientcmd"
+)
+
+var (
+	kubeconfig   = flag.String("kubeconfig", "", "Path to a kubeconfig file. Leave empty to use in-cluster config.")
+	ecmpMode     = flag.String("ecmp-mode", string(bgp.ECMPModeLocal), "How proxy hosts are selected for BGP announcement: local or cluster.")
+	metricsAddr  = flag.String("metrics-addr", ":9100", "Address the /metrics endpoint is served on.")
+	otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP trace collector endpoint (e.g. otel-collector:4318). Leave empty to disable tracing.")
+	otlpService  = flag.String("otlp-service-name", "kube-parrot", "Service name reported to the OTLP trace collector.")
+	resync       = flag.Duration("resync-period", 30*time.Second, "Informer resync period.")
+)
+
+func main() {
+	flag.Parse()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shutdownTracing, err := trace.Init(ctx, *otlpEndpoint, *otlpService)
+	if err != nil {
+		glog.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	defer shutdownTracing(ctx)
+
+	go func() {
+		glog.Infof("Serving metrics on %s/metrics", *metricsAddr)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+			glog.Fatalf("Metrics server failed: %v", err)
+		}
+	}()
+
+	var config *rest.Config
+	if *kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		glog.Fatalf("Failed to build Kubernetes client config: %v", err)
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		glog.Fatalf("Failed to build Kubernetes client: %v", err)
+	}
+
+	informers := informer.NewSharedInformerFactory(client, *resync)
+
+	bgpServer := server.NewBgpServer()
+	go bgpServer.Serve()
+
+	hostIP := net.ParseIP(os.Getenv("HOST_IP"))
+	routes := bgp.NewExternalIPRoutesStore(bgpServer, bgp.BundlerConfig{})
+
+	mode := bgp.ECMPMode(*ecmpMode)
+	switch mode {
+	case bgp.ECMPModeLocal, bgp.ECMPModeCluster:
+	default:
+		glog.Fatalf("Unknown --ecmp-mode %q: must be %q or %q", *ecmpMode, bgp.ECMPModeLocal, bgp.ECMPModeCluster)
+	}
+
+	var ecmpRoutes *bgp.ECMPRoutesStore
+	if mode != bgp.ECMPModeLocal {
+		ecmpRoutes = bgp.NewECMPRoutesStore(bgpServer)
+	}
+
+	externalServices := controller.NewExternalServicesController(informers, hostIP, routes, mode, ecmpRoutes)
+	loadBalancerServices := controller.NewLoadBalancerServicesController(informers, client, routes, ecmpRoutes)
+
+	// Reconcile LoadBalancer status as soon as a route actually lands
+	// instead of waiting for loadBalancerServices' own poll tick.
+	routes.SetOnChange(loadBalancerServices.Dirty)
+	if ecmpRoutes != nil {
+		ecmpRoutes.SetOnChange(loadBalancerServices.Dirty)
+	}
+
+	stopCh := make(chan struct{})
+	informers.Start(stopCh)
+
+	var wg sync.WaitGroup
+	go externalServices.Run(stopCh, &wg)
+	go loadBalancerServices.Run(stopCh, &wg)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	close(stopCh)
+	wg.Wait()
+}
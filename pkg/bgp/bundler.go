@@ -0,0 +1,141 @@
+package bgp
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	bgppkt "github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/table"
+	"github.com/sapcc/kube-parrot/pkg/metrics"
+	"github.com/sapcc/kube-parrot/pkg/util"
+	"google.golang.org/api/support/bundler"
+)
+
+// BundlerConfig tunes how ExternalIPRoutesStore batches route changes into
+// BGP UPDATE messages. A zero-value BundlerConfig uses the bundler
+// package's defaults.
+type BundlerConfig struct {
+	// MaxRoutes is the maximum number of route changes flushed in a single
+	// BGP UPDATE.
+	MaxRoutes int
+
+	// MaxBytes is the maximum approximate wire size of a single BGP UPDATE.
+	MaxBytes int
+
+	// MaxDelay is how long a route change can sit in a bundle before it is
+	// flushed regardless of MaxRoutes/MaxBytes.
+	MaxDelay time.Duration
+}
+
+// routeOp is a single pending route addition or withdrawal, queued for the
+// next flush of its bundle.
+type routeOp struct {
+	add   bool
+	route *ExternalIPRoute
+}
+
+func newBundler(cfg BundlerConfig, handler func([]*routeOp)) *bundler.Bundler {
+	b := bundler.NewBundler(&routeOp{}, func(bundle interface{}) {
+		handler(bundle.([]*routeOp))
+	})
+
+	if cfg.MaxRoutes > 0 {
+		b.BundleCountThreshold = cfg.MaxRoutes
+	}
+	if cfg.MaxBytes > 0 {
+		b.BundleByteLimit = cfg.MaxBytes
+	}
+	if cfg.MaxDelay > 0 {
+		b.DelayThreshold = cfg.MaxDelay
+	}
+
+	return b
+}
+
+// flush sends a single BGP UPDATE per affected peer covering every route
+// change queued in bundle, instead of one session write per route. Whether
+// an enqueued route actually reached the peer is only known here, so this
+// is also where routes-added/routes-withdrawn/bgp-send-errors are counted,
+// not at the point the caller enqueued the change.
+func (s *ExternalIPRoutesStore) flush(bundle []*routeOp) {
+	var toAdd, toDelete []*table.Path
+
+	for _, op := range coalesce(bundle) {
+		for _, ip := range util.ServiceExternalIPs(op.route.Service) {
+			path := s.path(op.route, ip, !op.add)
+			if op.add {
+				toAdd = append(toAdd, path)
+			} else {
+				toDelete = append(toDelete, path)
+			}
+		}
+	}
+
+	if len(toAdd) > 0 {
+		if _, err := s.server.AddPath("", toAdd); err != nil {
+			glog.Errorf("Failed to add %d bundled BGP paths: %v", len(toAdd), err)
+			metrics.BGPSendErrors.Add(float64(len(toAdd)))
+		} else {
+			metrics.RoutesAdded.Add(float64(len(toAdd)))
+		}
+	}
+
+	if len(toDelete) > 0 {
+		if err := s.server.DeletePath(nil, 0, "", toDelete); err != nil {
+			glog.Errorf("Failed to delete %d bundled BGP paths: %v", len(toDelete), err)
+			metrics.BGPSendErrors.Add(float64(len(toDelete)))
+		} else {
+			metrics.RoutesWithdrawn.Add(float64(len(toDelete)))
+		}
+	}
+
+	if len(toAdd) > 0 || len(toDelete) > 0 {
+		s.mu.Lock()
+		onChange := s.onChange
+		s.mu.Unlock()
+		if onChange != nil {
+			onChange()
+		}
+	}
+}
+
+// coalesce collapses bundle down to at most one op per route key, keeping
+// only the last one queued. flush applies every add before every delete to
+// send one BGP UPDATE per direction instead of one per route change, which
+// would otherwise reorder a delete-then-add of the same route within a
+// single bundle into add-then-delete on the wire, leaving the route
+// withdrawn even though s.routes still records it as announced. Collapsing
+// to the last op per key first means only the route's final desired state
+// within this flush window is ever sent.
+func coalesce(bundle []*routeOp) []*routeOp {
+	last := make(map[string]*routeOp, len(bundle))
+	order := make([]string, 0, len(bundle))
+
+	for _, op := range bundle {
+		key := routeKey(op.route.Service, op.route.Proxy)
+		if _, seen := last[key]; !seen {
+			order = append(order, key)
+		}
+		last[key] = op
+	}
+
+	ops := make([]*routeOp, 0, len(order))
+	for _, key := range order {
+		ops = append(ops, last[key])
+	}
+	return ops
+}
+
+// path builds the BGP path attributes/NLRI for route's ip. withdraw marks
+// the path as a withdrawal, matching table.NewPath's semantics.
+func (s *ExternalIPRoutesStore) path(route *ExternalIPRoute, ip string, withdraw bool) *table.Path {
+	attrs := []bgppkt.PathAttributeInterface{
+		bgppkt.NewPathAttributeNextHop(route.Proxy.Status.HostIP),
+	}
+	if !withdraw {
+		attrs = append([]bgppkt.PathAttributeInterface{bgppkt.NewPathAttributeOrigin(0)}, attrs...)
+	}
+
+	nlri := bgppkt.NewIPAddrPrefix(32, ip)
+	return table.NewPath(nil, nlri, withdraw, attrs, time.Now(), false)
+}
@@ -0,0 +1,178 @@
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	bgppkt "github.com/osrg/gobgp/packet/bgp"
+	"github.com/osrg/gobgp/server"
+	"github.com/osrg/gobgp/table"
+	"github.com/sapcc/kube-parrot/pkg/util"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+)
+
+// ECMPMode selects which proxy hosts a controller using ECMPRoutesStore
+// announces a given service externalIP from.
+type ECMPMode string
+
+const (
+	// ECMPModeLocal announces only from the local node's own kube-proxy,
+	// matching ExternalServicesController's historical behaviour.
+	ECMPModeLocal ECMPMode = "local"
+
+	// ECMPModeCluster announces from every node with a Ready kube-proxy and
+	// a Ready endpoint for the service, so upstream routers can ECMP-hash
+	// across all of them.
+	ECMPModeCluster ECMPMode = "cluster"
+)
+
+// ECMPPath is a single next-hop for a multipath-announced prefix.
+type ECMPPath struct {
+	Service *v1.Service
+	Proxy   *v1.Pod
+	NextHop net.IP
+}
+
+// ECMPRoutesStore announces BGP multipath routes: it groups ECMPPaths by
+// prefix (the service's externalIP) and keeps every healthy next-hop
+// announced for that prefix simultaneously. Withdrawing a single path
+// leaves the other next-hops for the same prefix announced, so a draining
+// node doesn't take the whole prefix down with it.
+type ECMPRoutesStore struct {
+	mu       sync.Mutex
+	server   *server.BgpServer
+	paths    map[string]map[string]*ECMPPath // prefix -> next-hop key -> path
+	onChange func()
+}
+
+// NewECMPRoutesStore returns a store that announces and withdraws multipath
+// routes through server.
+func NewECMPRoutesStore(server *server.BgpServer) *ECMPRoutesStore {
+	return &ECMPRoutesStore{
+		server: server,
+		paths:  make(map[string]map[string]*ECMPPath),
+	}
+}
+
+func pathKey(path *ECMPPath) string {
+	return fmt.Sprintf("%s@%s", path.NextHop.String(), path.Proxy.Name)
+}
+
+// SetOnChange registers fn to be called after Add or Delete actually
+// changes a path at the peer, so callers that need to react promptly to a
+// path landing can use this instead of polling List() on their own
+// interval.
+func (s *ECMPRoutesStore) SetOnChange(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = fn
+}
+
+// Add announces path's next-hop for every externalIP of path.Service,
+// leaving any other next-hops already announced for those prefixes in
+// place.
+func (s *ECMPRoutesStore) Add(path *ECMPPath) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := pathKey(path)
+	changed := false
+
+	for _, ip := range util.ServiceExternalIPs(path.Service) {
+		if _, ok := s.paths[ip]; !ok {
+			s.paths[ip] = make(map[string]*ECMPPath)
+		}
+
+		if _, exists := s.paths[ip][key]; exists {
+			continue
+		}
+
+		if err := s.announce(ip, path); err != nil {
+			return err
+		}
+
+		s.paths[ip][key] = path
+		changed = true
+	}
+
+	if changed && s.onChange != nil {
+		s.onChange()
+	}
+
+	return nil
+}
+
+// Delete withdraws only path's next-hop from every externalIP of
+// path.Service; other next-hops for the same prefixes are left announced.
+func (s *ECMPRoutesStore) Delete(path *ECMPPath) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := pathKey(path)
+	changed := false
+
+	for _, ip := range util.ServiceExternalIPs(path.Service) {
+		if _, exists := s.paths[ip][key]; !exists {
+			continue
+		}
+
+		if err := s.withdraw(ip, path); err != nil {
+			return err
+		}
+
+		delete(s.paths[ip], key)
+		if len(s.paths[ip]) == 0 {
+			delete(s.paths, ip)
+		}
+		changed = true
+	}
+
+	if changed && s.onChange != nil {
+		s.onChange()
+	}
+
+	return nil
+}
+
+// List returns every next-hop path currently announced.
+func (s *ECMPRoutesStore) List() []*ECMPPath {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var paths []*ECMPPath
+	for _, byNextHop := range s.paths {
+		for _, path := range byNextHop {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func (s *ECMPRoutesStore) announce(prefix string, path *ECMPPath) error {
+	attrs := []bgppkt.PathAttributeInterface{
+		bgppkt.NewPathAttributeOrigin(0),
+		bgppkt.NewPathAttributeNextHop(path.NextHop.String()),
+	}
+	nlri := bgppkt.NewIPAddrPrefix(32, prefix)
+	p := table.NewPath(nil, nlri, false, attrs, time.Now(), false)
+
+	if _, err := s.server.AddPath("", []*table.Path{p}); err != nil {
+		return fmt.Errorf("failed to add ECMP BGP path for %s via %s: %v", prefix, path.NextHop, err)
+	}
+	return nil
+}
+
+func (s *ECMPRoutesStore) withdraw(prefix string, path *ECMPPath) error {
+	attrs := []bgppkt.PathAttributeInterface{
+		bgppkt.NewPathAttributeNextHop(path.NextHop.String()),
+	}
+	nlri := bgppkt.NewIPAddrPrefix(32, prefix)
+	p := table.NewPath(nil, nlri, true, attrs, time.Now(), false)
+
+	if err := s.server.DeletePath(nil, 0, "", []*table.Path{p}); err != nil {
+		return fmt.Errorf("failed to delete ECMP BGP path for %s via %s: %v", prefix, path.NextHop, err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Package bgp manages the BGP routes kube-parrot announces to its peers
+// through a local GoBGP speaker.
+package bgp
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/osrg/gobgp/server"
+	"github.com/sapcc/kube-parrot/pkg/util"
+	"google.golang.org/api/support/bundler"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+)
+
+// ExternalIPRoute is a single BGP route announced for one of a service's
+// externalIPs, using a proxy pod's host as next-hop.
+type ExternalIPRoute struct {
+	Service *v1.Service
+	Proxy   *v1.Pod
+}
+
+// ExternalIPRoutesStore reconciles the set of BGP routes announced for
+// Kubernetes Service externalIPs against a local GoBGP speaker. Route
+// changes are batched by a bundler so a burst of churn produces a handful
+// of BGP UPDATEs instead of one session write per route change.
+type ExternalIPRoutesStore struct {
+	mu       sync.Mutex
+	server   *server.BgpServer
+	bundler  *bundler.Bundler
+	routes   map[string]*ExternalIPRoute
+	onChange func()
+}
+
+// NewExternalIPRoutesStore returns a store that announces and withdraws
+// routes through server, batching wire writes per cfg.
+func NewExternalIPRoutesStore(server *server.BgpServer, cfg BundlerConfig) *ExternalIPRoutesStore {
+	s := &ExternalIPRoutesStore{
+		server: server,
+		routes: make(map[string]*ExternalIPRoute),
+	}
+	s.bundler = newBundler(cfg, s.flush)
+	return s
+}
+
+func routeKey(service *v1.Service, proxy *v1.Pod) string {
+	return fmt.Sprintf("%s/%s@%s", service.Namespace, service.Name, proxy.Name)
+}
+
+// estimatedPathBytes approximates the wire size of a single BGP UPDATE path
+// (NLRI plus ORIGIN/NEXT_HOP attributes), for sizing bundler.Add's byte
+// argument against BundlerConfig.MaxBytes/BundleByteLimit.
+const estimatedPathBytes = 32
+
+// routeBytes estimates the wire size of announcing/withdrawing every one of
+// service's externalIPs in a single route change.
+func routeBytes(service *v1.Service) int {
+	return len(util.ServiceExternalIPs(service)) * estimatedPathBytes
+}
+
+// Add queues a BGP route announcement for each of service's externalIPs,
+// using proxy's host as next-hop. It is a no-op if the route is already
+// announced. The actual BGP UPDATE is sent once the bundle flushes.
+func (s *ExternalIPRoutesStore) Add(service *v1.Service, proxy *v1.Pod) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := routeKey(service, proxy)
+	if _, exists := s.routes[key]; exists {
+		return nil
+	}
+
+	route := &ExternalIPRoute{Service: service, Proxy: proxy}
+	if err := s.bundler.Add(&routeOp{add: true, route: route}, routeBytes(service)); err != nil {
+		return fmt.Errorf("failed to queue BGP route for %s/%s: %v", service.Namespace, service.Name, err)
+	}
+
+	s.routes[key] = route
+	return nil
+}
+
+// Delete queues a withdrawal of route's BGP paths. The actual BGP UPDATE is
+// sent once the bundle flushes.
+func (s *ExternalIPRoutesStore) Delete(route *ExternalIPRoute) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := routeKey(route.Service, route.Proxy)
+	if _, exists := s.routes[key]; !exists {
+		return nil
+	}
+
+	if err := s.bundler.Add(&routeOp{add: false, route: route}, routeBytes(route.Service)); err != nil {
+		return fmt.Errorf("failed to queue BGP withdrawal for %s/%s: %v", route.Service.Namespace, route.Service.Name, err)
+	}
+
+	delete(s.routes, key)
+	return nil
+}
+
+// SetOnChange registers fn to be called after a bundle flush actually
+// changes routes at the peer. Routes are only installed/withdrawn
+// asynchronously once their bundle flushes, so callers that need to react
+// promptly to a route landing -- rather than on their own poll interval --
+// should use this instead of polling List().
+func (s *ExternalIPRoutesStore) SetOnChange(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = fn
+}
+
+// List returns the routes recorded as announced: every route Add has queued
+// and Delete has not since queued for withdrawal. A listed route may not
+// have been flushed to the peer yet, and stays listed if its flush fails.
+func (s *ExternalIPRoutesStore) List() []*ExternalIPRoute {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	routes := make([]*ExternalIPRoute, 0, len(s.routes))
+	for _, route := range s.routes {
+		routes = append(routes, route)
+	}
+	return routes
+}
@@ -1,42 +1,70 @@
 package controller
 
 import (
+	"context"
 	"net"
 	"strings"
 	"sync"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/kube-parrot/pkg/bgp"
 	"github.com/sapcc/kube-parrot/pkg/forked/informer"
+	"github.com/sapcc/kube-parrot/pkg/forked/reconciler"
 	"github.com/sapcc/kube-parrot/pkg/forked/util"
+	"github.com/sapcc/kube-parrot/pkg/metrics"
+	"github.com/sapcc/kube-parrot/pkg/trace"
 	"github.com/sapcc/kube-parrot/pkg/types"
-	"github.com/sapcc/kube-parrot/pkg/util"
+	kubeutil "github.com/sapcc/kube-parrot/pkg/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"k8s.io/client-go/1.5/pkg/api/v1"
 	"k8s.io/client-go/1.5/tools/cache"
 )
 
 type ExternalServicesController struct {
 	routes     *bgp.ExternalIPRoutesStore
+	ecmpRoutes *bgp.ECMPRoutesStore
+	ecmpMode   bgp.ECMPMode
 	reconciler reconciler.DirtyReconcilerInterface
 	hostIP     net.IP
 
 	services  cache.Store
 	endpoints cache.Store
 	proxies   cache.Store
+	nodes     cache.Store
 }
 
+// NewExternalServicesController returns a controller that announces BGP
+// routes for Service externalIPs. ecmpMode selects which proxy hosts a
+// route is announced from: bgp.ECMPModeLocal (the default) announces only
+// from this node's own kube-proxy via routes; bgp.ECMPModeCluster announces
+// from every node with a Ready kube-proxy via ecmpRoutes, letting upstream
+// routers ECMP across them. ecmpRoutes may be nil when ecmpMode is
+// bgp.ECMPModeLocal.
 func NewExternalServicesController(informers informer.SharedInformerFactory,
-	hostIP net.IP, routes *bgp.ExternalIPRoutesStore) *ExternalServicesController {
+	hostIP net.IP, routes *bgp.ExternalIPRoutesStore,
+	ecmpMode bgp.ECMPMode, ecmpRoutes *bgp.ECMPRoutesStore) *ExternalServicesController {
 
 	c := &ExternalServicesController{
-		routes:    routes,
-		hostIP:    hostIP,
-		services:  cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
-		endpoints: cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
-		proxies:   cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
+		routes:     routes,
+		ecmpRoutes: ecmpRoutes,
+		ecmpMode:   ecmpMode,
+		hostIP:     hostIP,
+		services:   cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
+		endpoints:  cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
+		proxies:    cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
+		nodes:      cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
 	}
 
-	c.reconciler = reconciler.NewNamedDirtyReconciler("externalips", c.reconcile)
+	// Endpoints/Pods/Nodes churn can fire Dirty() far more often than the BGP
+	// peer needs a new reconcile; limit it to at most 10 immediate
+	// reconciles/second, coalescing the rest into the next tick.
+	policy, err := reconciler.NewLimitedSampler(1, 10)
+	if err != nil {
+		panic(err)
+	}
+	c.reconciler = reconciler.NewLimitedDirtyReconciler("externalips", c.reconcile, policy)
 
 	informers.Endpoints().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    c.endpointsAdd,
@@ -56,6 +84,12 @@ func NewExternalServicesController(informers informer.SharedInformerFactory,
 		DeleteFunc: c.serviceDelete,
 	})
 
+	informers.Nodes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.nodeAdd,
+		UpdateFunc: c.nodeUpdate,
+		DeleteFunc: c.nodeDelete,
+	})
+
 	return c
 }
 
@@ -68,12 +102,20 @@ func (c *ExternalServicesController) Run(stopCh <-chan struct{}, wg *sync.WaitGr
 	<-stopCh
 }
 
+// dirty marks the reconciler dirty and accounts for it in the
+// dirty-queue-depth gauge, which reconcile() resets at the start of every
+// cycle.
+func (c *ExternalServicesController) dirty() {
+	metrics.DirtyQueueDepth.Inc()
+	c.reconciler.Dirty()
+}
+
 func (c *ExternalServicesController) podDelete(obj interface{}) {
 	pod := obj.(*v1.Pod)
 	if _, exists, _ := c.proxies.Get(pod); exists {
 		glog.V(3).Infof("Deleting Kube-Proxy (%s)", pod.Name)
 		c.proxies.Delete(pod)
-		c.reconciler.Dirty()
+		c.dirty()
 	}
 }
 
@@ -84,7 +126,7 @@ func (c *ExternalServicesController) podAdd(obj interface{}) {
 		return
 	}
 
-	if pod.Status.HostIP != c.hostIP.To4().String() {
+	if c.ecmpMode == bgp.ECMPModeLocal && pod.Status.HostIP != c.hostIP.To4().String() {
 		return
 	}
 
@@ -93,14 +135,14 @@ func (c *ExternalServicesController) podAdd(obj interface{}) {
 		if _, exists, _ := c.proxies.Get(pod); !exists {
 			glog.V(3).Infof("Adding Kube-Proxy (%s)", pod.Name)
 			c.proxies.Add(pod)
-			c.reconciler.Dirty()
+			c.dirty()
 		}
 	} else {
 		glog.V(5).Infof("Kube-Proxy is NOT ready (%s)", pod.Name)
 		if _, exists, _ := c.proxies.Get(pod); exists {
 			glog.V(3).Infof("Deleting Kube-Proxy (%s)", pod.Name)
 			c.proxies.Delete(pod)
-			c.reconciler.Dirty()
+			c.dirty()
 		}
 	}
 
@@ -114,36 +156,25 @@ func (c *ExternalServicesController) serviceDelete(obj interface{}) {
 	service := obj.(*v1.Service)
 	glog.V(3).Infof("Deleting Service (%s)", service.Name)
 	c.services.Delete(service)
-	c.reconciler.Dirty()
+	c.dirty()
 }
 
 func (c *ExternalServicesController) serviceAdd(obj interface{}) {
 	service := obj.(*v1.Service)
-	//if l, ok := service.Annotations[types.AnnotationBGPAnnouncement]; ok {
-	//  announcementRequested, err := strconv.ParseBool(l)
-	//  if err != nil {
-	//    glog.Errorf("Failed to parse annotation %v: %v", types.AnnotationBGPAnnouncement, err)
-	//    return
-	//  }
-
-	//  if !announcementRequested {
-	//    glog.V(3).Infof("Skipping service %v. Annotation is set but not true. Huh?", service.GetName())
-	//    return
-	//  }
-	//} else {
-	//  glog.V(5).Infof("Skipping service %v. No announce annotation defined...", service.GetName())
-	//  return
-	//}
-
-	if len(service.Spec.ExternalIPs) == 0 {
+
+	// Spec.ExternalIPs is always announced. For Type: LoadBalancer services,
+	// Spec.LoadBalancerIP is additionally announced when the announce
+	// annotation is set; Status.LoadBalancer.Ingress IPs are not announced,
+	// see kubeutil.ServiceExternalIPs.
+	if len(kubeutil.ServiceExternalIPs(service)) == 0 {
 		glog.V(3).Infof("Skipping service %v. No externalIP defined...", service.GetName())
 		return
 	}
 
 	if _, exists, _ := c.services.Get(service); !exists {
-		glog.V(3).Infof("Deleting Service (%s)", service.Name)
+		glog.V(3).Infof("Adding Service (%s)", service.Name)
 		c.services.Add(service)
-		c.reconciler.Dirty()
+		c.dirty()
 	}
 }
 
@@ -151,13 +182,68 @@ func (c *ExternalServicesController) serviceUpdate(old, cur interface{}) {
 	c.serviceAdd(cur)
 }
 
+func (c *ExternalServicesController) nodeDelete(obj interface{}) {
+	node := obj.(*v1.Node)
+	if _, exists, _ := c.nodes.Get(node); exists {
+		glog.V(3).Infof("Deleting Node (%s)", node.Name)
+		c.nodes.Delete(node)
+		c.dirty()
+	}
+}
+
+func (c *ExternalServicesController) nodeAdd(obj interface{}) {
+	node := obj.(*v1.Node)
+
+	if isNodeReady(node) {
+		if _, exists, _ := c.nodes.Get(node); !exists {
+			glog.V(3).Infof("Adding Node (%s)", node.Name)
+			c.nodes.Add(node)
+			c.dirty()
+		}
+	} else {
+		if _, exists, _ := c.nodes.Get(node); exists {
+			glog.V(3).Infof("Deleting Node (%s)", node.Name)
+			c.nodes.Delete(node)
+			c.dirty()
+		}
+	}
+}
+
+func (c *ExternalServicesController) nodeUpdate(old, cur interface{}) {
+	c.nodeAdd(cur)
+}
+
+// isNodeReady reports whether node's NodeReady condition is true.
+func isNodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// nodeReady reports whether hostIP belongs to a node this controller has
+// observed as Ready.
+func (c *ExternalServicesController) nodeReady(hostIP string) bool {
+	for _, obj := range c.nodes.List() {
+		node := obj.(*v1.Node)
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == v1.NodeInternalIP && addr.Address == hostIP {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (c *ExternalServicesController) endpointsDelete(obj interface{}) {
 	endpoints := obj.(*v1.Endpoints)
 
 	if _, exists, _ := c.endpoints.Get(endpoints); exists {
 		glog.V(3).Infof("Deleting Endpoints (%s/%s)", endpoints.Namespace, endpoints.Name)
 		c.endpoints.Delete(endpoints)
-		c.reconciler.Dirty()
+		c.dirty()
 	}
 }
 
@@ -177,7 +263,7 @@ func (c *ExternalServicesController) endpointsAdd(obj interface{}) {
 		if _, exists, _ := c.endpoints.Get(endpoints); !exists {
 			glog.V(3).Infof("Adding Endpoints (%s/%s)", endpoints.Namespace, endpoints.Name)
 			c.endpoints.Add(endpoints)
-			c.reconciler.Dirty()
+			c.dirty()
 		}
 	} else {
 		if !strings.HasSuffix(endpoints.Name, "kube-scheduler") &&
@@ -187,7 +273,7 @@ func (c *ExternalServicesController) endpointsAdd(obj interface{}) {
 		if _, exists, _ := c.endpoints.Get(endpoints); exists {
 			glog.V(3).Infof("Deleting Endpoints (%s/%s)", endpoints.Namespace, endpoints.Name)
 			c.endpoints.Delete(endpoints)
-			c.reconciler.Dirty()
+			c.dirty()
 		}
 	}
 }
@@ -197,21 +283,32 @@ func (c *ExternalServicesController) endpointsUpdate(old, cur interface{}) {
 }
 
 func (c *ExternalServicesController) reconcile() error {
+	ctx, span := trace.Tracer().Start(context.Background(), "ExternalServicesController.reconcile")
+	defer span.End()
+
+	timer := prometheus.NewTimer(metrics.ReconcileDuration)
+	defer timer.ObserveDuration()
+	metrics.DirtyQueueDepth.Set(0)
+
+	if c.ecmpMode != bgp.ECMPModeLocal {
+		return c.reconcileECMP(ctx)
+	}
+
 	for _, route := range c.routes.List() {
 		if _, ok, _ := c.proxies.Get(route.Proxy); !ok {
-			if err := c.routes.Delete(route); err != nil {
+			if err := c.deleteRoute(ctx, route); err != nil {
 				return err
 			}
 		}
 
 		if _, ok, _ := c.services.Get(route.Service); !ok {
-			if err := c.routes.Delete(route); err != nil {
+			if err := c.deleteRoute(ctx, route); err != nil {
 				return err
 			}
 		}
 
 		if _, ok, _ := c.endpoints.Get(route.Service); !ok {
-			if err := c.routes.Delete(route); err != nil {
+			if err := c.deleteRoute(ctx, route); err != nil {
 				return err
 			}
 		}
@@ -220,7 +317,7 @@ func (c *ExternalServicesController) reconcile() error {
 	for _, proxy := range c.proxies.List() {
 		for _, service := range c.services.List() {
 			if _, ok, _ := c.endpoints.Get(service); ok {
-				if err := c.routes.Add(service.(*v1.Service), proxy.(*v1.Pod)); err != nil {
+				if err := c.addRoute(ctx, service.(*v1.Service), proxy.(*v1.Pod)); err != nil {
 					return err
 				}
 			}
@@ -229,3 +326,147 @@ func (c *ExternalServicesController) reconcile() error {
 
 	return nil
 }
+
+// reconcileECMP announces one BGP path per (service, Ready proxy) pair via
+// ecmpRoutes instead of a single path per service via routes, so upstream
+// routers can multipath-hash across every healthy kube-proxy in the
+// cluster. Withdrawing a drained node only removes its own path, leaving
+// the prefix's other next-hops announced.
+func (c *ExternalServicesController) reconcileECMP(ctx context.Context) error {
+	for _, path := range c.ecmpRoutes.List() {
+		_, serviceOk, _ := c.services.Get(path.Service)
+		_, endpointsOk, _ := c.endpoints.Get(path.Service)
+		_, proxyOk, _ := c.proxies.Get(path.Proxy)
+
+		if !serviceOk || !endpointsOk || !proxyOk || !c.nodeReady(path.Proxy.Status.HostIP) {
+			if err := c.deleteECMPPath(ctx, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, obj := range c.services.List() {
+		service := obj.(*v1.Service)
+		if _, ok, _ := c.endpoints.Get(service); !ok {
+			continue
+		}
+
+		for _, obj := range c.proxies.List() {
+			proxy := obj.(*v1.Pod)
+			if !c.nodeReady(proxy.Status.HostIP) {
+				continue
+			}
+
+			path := &bgp.ECMPPath{
+				Service: service,
+				Proxy:   proxy,
+				NextHop: net.ParseIP(proxy.Status.HostIP),
+			}
+
+			if err := c.addECMPPath(ctx, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// addECMPPath announces a single ECMP next-hop under a child span of the
+// reconcile cycle in ctx, and accounts for the result in the
+// routes-added/bgp-send-error counters.
+func (c *ExternalServicesController) addECMPPath(ctx context.Context, path *bgp.ECMPPath) error {
+	_, span := trace.Tracer().Start(ctx, "ecmpRoutes.Add")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("service.namespace", path.Service.Namespace),
+		attribute.String("service.name", path.Service.Name),
+		attribute.StringSlice("service.externalIPs", path.Service.Spec.ExternalIPs),
+		attribute.String("proxy.pod", path.Proxy.Name),
+		attribute.String("proxy.hostIP", path.NextHop.String()),
+		attribute.String("peer.endpoint", path.NextHop.String()),
+	)
+
+	if err := c.ecmpRoutes.Add(path); err != nil {
+		metrics.BGPSendErrors.Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	metrics.RoutesAdded.Inc()
+	return nil
+}
+
+// deleteECMPPath withdraws a single ECMP next-hop under a child span of the
+// reconcile cycle in ctx, and accounts for the result in the
+// routes-withdrawn/bgp-send-error counters.
+func (c *ExternalServicesController) deleteECMPPath(ctx context.Context, path *bgp.ECMPPath) error {
+	_, span := trace.Tracer().Start(ctx, "ecmpRoutes.Delete")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("service.namespace", path.Service.Namespace),
+		attribute.String("service.name", path.Service.Name),
+		attribute.String("proxy.pod", path.Proxy.Name),
+		attribute.String("peer.endpoint", path.NextHop.String()),
+	)
+
+	if err := c.ecmpRoutes.Delete(path); err != nil {
+		metrics.BGPSendErrors.Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	metrics.RoutesWithdrawn.Inc()
+	return nil
+}
+
+// addRoute enqueues a single BGP route announcement for service/proxy under
+// a child span of the reconcile cycle in ctx. The route is batched by
+// ExternalIPRoutesStore and actually sent when its bundle flushes, so this
+// span only covers the enqueue step; routes-added and bgp-send-errors are
+// accounted for there, against the real send outcome, not here.
+func (c *ExternalServicesController) addRoute(ctx context.Context, service *v1.Service, proxy *v1.Pod) error {
+	_, span := trace.Tracer().Start(ctx, "routes.Add")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("service.namespace", service.Namespace),
+		attribute.String("service.name", service.Name),
+		attribute.StringSlice("service.externalIPs", service.Spec.ExternalIPs),
+		attribute.String("proxy.pod", proxy.Name),
+		attribute.String("proxy.hostIP", proxy.Status.HostIP),
+		attribute.String("peer.endpoint", proxy.Status.HostIP),
+	)
+
+	if err := c.routes.Add(service, proxy); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// deleteRoute enqueues the withdrawal of route under a child span of the
+// reconcile cycle in ctx. As with addRoute, the actual BGP send happens
+// later when the bundle flushes, so routes-withdrawn and bgp-send-errors
+// are accounted for there instead of here.
+func (c *ExternalServicesController) deleteRoute(ctx context.Context, route *bgp.ExternalIPRoute) error {
+	_, span := trace.Tracer().Start(ctx, "routes.Delete")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("service.namespace", route.Service.Namespace),
+		attribute.String("service.name", route.Service.Name),
+		attribute.String("proxy.pod", route.Proxy.Name),
+		attribute.String("peer.endpoint", route.Proxy.Status.HostIP),
+	)
+
+	if err := c.routes.Delete(route); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	return nil
+}
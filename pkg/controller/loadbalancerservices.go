@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/sapcc/kube-parrot/pkg/bgp"
+	"github.com/sapcc/kube-parrot/pkg/forked/informer"
+	"github.com/sapcc/kube-parrot/pkg/forked/reconciler"
+	"github.com/sapcc/kube-parrot/pkg/types"
+	kubeutil "github.com/sapcc/kube-parrot/pkg/util"
+	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/tools/cache"
+)
+
+// LoadBalancerServicesController mirrors the externalIPs kube-parrot has
+// actually announced via BGP back onto a Type: LoadBalancer Service's
+// Status.LoadBalancer.Ingress, so `kubectl get svc` reflects reality
+// instead of staying stuck on <pending>.
+type LoadBalancerServicesController struct {
+	client     kubernetes.Interface
+	routes     *bgp.ExternalIPRoutesStore
+	ecmpRoutes *bgp.ECMPRoutesStore
+
+	reconciler reconciler.DirtyReconcilerInterface
+	services   cache.Store
+}
+
+// NewLoadBalancerServicesController returns a controller that updates the
+// LoadBalancer status of announce-annotated Type: LoadBalancer Services
+// once routes are installed for them in routes or, when running in a
+// cluster ECMP mode, ecmpRoutes. ecmpRoutes may be nil when the caller only
+// ever installs routes through routes (bgp.ECMPModeLocal).
+func NewLoadBalancerServicesController(informers informer.SharedInformerFactory,
+	client kubernetes.Interface, routes *bgp.ExternalIPRoutesStore,
+	ecmpRoutes *bgp.ECMPRoutesStore) *LoadBalancerServicesController {
+
+	c := &LoadBalancerServicesController{
+		client:     client,
+		routes:     routes,
+		ecmpRoutes: ecmpRoutes,
+		services:   cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
+	}
+
+	c.reconciler = reconciler.NewNamedDirtyReconciler("loadbalancerservices", c.reconcile)
+
+	informers.Services().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.serviceAdd,
+		UpdateFunc: c.serviceUpdate,
+		DeleteFunc: c.serviceDelete,
+	})
+
+	return c
+}
+
+func (c *LoadBalancerServicesController) Run(stopCh <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	wg.Add(1)
+
+	c.reconciler.Run(stopCh)
+
+	<-stopCh
+}
+
+// Dirty marks the controller dirty, triggering a reconcile as soon as
+// possible instead of waiting for the next tick. routes/ecmpRoutes call
+// this via SetOnChange when a BGP route actually lands, so status mirrors
+// reality promptly instead of only on the reconciler's own poll interval.
+func (c *LoadBalancerServicesController) Dirty() {
+	c.reconciler.Dirty()
+}
+
+func (c *LoadBalancerServicesController) serviceDelete(obj interface{}) {
+	service := obj.(*v1.Service)
+	if _, exists, _ := c.services.Get(service); exists {
+		glog.V(3).Infof("Deleting LoadBalancer Service (%s)", service.Name)
+		c.services.Delete(service)
+		c.reconciler.Dirty()
+	}
+}
+
+func (c *LoadBalancerServicesController) serviceAdd(obj interface{}) {
+	service := obj.(*v1.Service)
+
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return
+	}
+
+	announce, _ := strconv.ParseBool(service.Annotations[types.AnnotationBGPAnnouncement])
+	if !announce {
+		return
+	}
+
+	if _, exists, _ := c.services.Get(service); !exists {
+		glog.V(3).Infof("Adding LoadBalancer Service (%s)", service.Name)
+	}
+
+	// Always overwrite rather than gating on existence: reconcile's
+	// DeepEqual guard compares against this stored object's Status, so it
+	// must track the latest object, including the Status our own
+	// UpdateStatus calls set.
+	c.services.Add(service)
+	c.reconciler.Dirty()
+}
+
+func (c *LoadBalancerServicesController) serviceUpdate(old, cur interface{}) {
+	c.serviceAdd(cur)
+}
+
+// reconcile sets Status.LoadBalancer.Ingress on every tracked service to
+// the externalIPs kube-parrot has actually announced for it.
+func (c *LoadBalancerServicesController) reconcile() error {
+	for _, obj := range c.services.List() {
+		service := obj.(*v1.Service)
+
+		if !c.announced(service) {
+			continue
+		}
+
+		ingress := make([]v1.LoadBalancerIngress, 0, len(kubeutil.ServiceExternalIPs(service)))
+		for _, ip := range kubeutil.ServiceExternalIPs(service) {
+			ingress = append(ingress, v1.LoadBalancerIngress{IP: ip})
+		}
+
+		if reflect.DeepEqual(service.Status.LoadBalancer.Ingress, ingress) {
+			continue
+		}
+
+		updated := *service
+		updated.Status.LoadBalancer.Ingress = ingress
+
+		result, err := c.client.Core().Services(updated.Namespace).UpdateStatus(&updated)
+		if err != nil {
+			return err
+		}
+
+		// Without this, c.services would keep the pre-update object until
+		// the informer redelivers it, so the DeepEqual guard above would
+		// keep comparing against the stale empty Ingress and re-issue this
+		// same UpdateStatus on every Dirty() and tick until then.
+		c.services.Update(result)
+
+		glog.V(3).Infof("Updated LoadBalancer status for Service (%s/%s)", service.Namespace, service.Name)
+	}
+
+	return nil
+}
+
+// announced reports whether at least one BGP route is currently installed
+// for service, via either routes or -- when running in a cluster ECMP mode
+// -- ecmpRoutes.
+func (c *LoadBalancerServicesController) announced(service *v1.Service) bool {
+	for _, route := range c.routes.List() {
+		if route.Service.UID == service.UID {
+			return true
+		}
+	}
+
+	if c.ecmpRoutes != nil {
+		for _, path := range c.ecmpRoutes.List() {
+			if path.Service.UID == service.UID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
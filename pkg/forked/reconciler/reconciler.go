@@ -0,0 +1,69 @@
+// Package reconciler implements a dirty-flag-driven reconcile loop, forked
+// from Kubernetes' iptables proxy reconciler: a reconcile function runs on
+// a fixed interval, but callers can call Dirty() to request it run sooner,
+// coalescing bursts of updates into a single cycle.
+package reconciler
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const tickInterval = 30 * time.Second
+
+// DirtyReconcilerInterface is run until stopCh is closed, reconciling
+// whenever Dirty() is called or the tick interval elapses.
+type DirtyReconcilerInterface interface {
+	Run(stopCh <-chan struct{})
+	Dirty()
+}
+
+type namedDirtyReconciler struct {
+	name string
+	fn   func() error
+
+	dirtyCh chan struct{}
+}
+
+// NewNamedDirtyReconciler returns a DirtyReconcilerInterface that calls fn
+// whenever it is marked dirty or the tick interval elapses. name is used
+// only for logging.
+func NewNamedDirtyReconciler(name string, fn func() error) DirtyReconcilerInterface {
+	return &namedDirtyReconciler{
+		name:    name,
+		fn:      fn,
+		dirtyCh: make(chan struct{}, 1),
+	}
+}
+
+func (r *namedDirtyReconciler) Dirty() {
+	select {
+	case r.dirtyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (r *namedDirtyReconciler) Run(stopCh <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(tickInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.dirtyCh:
+				r.reconcile()
+			case <-ticker.C:
+				r.reconcile()
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (r *namedDirtyReconciler) reconcile() {
+	if err := r.fn(); err != nil {
+		glog.Errorf("Reconciler %q failed: %v", r.name, err)
+	}
+}
@@ -0,0 +1,95 @@
+package reconciler
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxBurst caps how many tokens a DirtyPolicy sampler can accumulate, so a
+// long idle period can't let it admit an unbounded burst once events
+// resume.
+const maxBurst = 2
+
+// DirtyPolicy decides, for a given Dirty() call, whether the reconciler
+// should run immediately or coalesce the event into the next scheduled
+// tick.
+type DirtyPolicy interface {
+	Sample(now time.Time) bool
+}
+
+// sampler is a token-bucket-plus-probability DirtyPolicy, ported from the
+// tracing client's sampler: tokens refill at maxqps capped at maxBurst, and
+// an event is admitted only if a coin flip at rate succeeds AND a token is
+// available.
+type sampler struct {
+	mu     sync.Mutex
+	rate   float64
+	maxqps float64
+
+	tokens   float64
+	lastTick time.Time
+}
+
+// NewLimitedSampler returns a DirtyPolicy that admits at most maxqps Dirty()
+// events per second, each additionally subject to a rate probability.
+func NewLimitedSampler(rate, maxqps float64) (DirtyPolicy, error) {
+	return &sampler{
+		rate:   rate,
+		maxqps: maxqps,
+		tokens: maxBurst,
+	}, nil
+}
+
+func (s *sampler) Sample(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sample(now, rand.Float64())
+}
+
+// sample is the deterministic core of Sample, split out so tests can drive
+// it with a fixed time sequence and random draw.
+func (s *sampler) sample(now time.Time, draw float64) bool {
+	if s.lastTick.IsZero() {
+		s.lastTick = now
+	}
+
+	s.tokens += now.Sub(s.lastTick).Seconds() * s.maxqps
+	if s.tokens > maxBurst {
+		s.tokens = maxBurst
+	}
+	s.lastTick = now
+
+	if draw < s.rate && s.tokens >= 1 {
+		s.tokens--
+		return true
+	}
+	return false
+}
+
+type limitedDirtyReconciler struct {
+	namedDirtyReconciler
+	policy DirtyPolicy
+}
+
+// NewLimitedDirtyReconciler returns a DirtyReconcilerInterface like
+// NewNamedDirtyReconciler, except each Dirty() call is first passed to
+// policy: only admitted calls trigger an immediate reconcile, others are
+// coalesced into the next tick.
+func NewLimitedDirtyReconciler(name string, fn func() error, policy DirtyPolicy) DirtyReconcilerInterface {
+	return &limitedDirtyReconciler{
+		namedDirtyReconciler: namedDirtyReconciler{
+			name:    name,
+			fn:      fn,
+			dirtyCh: make(chan struct{}, 1),
+		},
+		policy: policy,
+	}
+}
+
+func (r *limitedDirtyReconciler) Dirty() {
+	if !r.policy.Sample(time.Now()) {
+		return
+	}
+	r.namedDirtyReconciler.Dirty()
+}
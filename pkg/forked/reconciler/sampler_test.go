@@ -0,0 +1,75 @@
+package reconciler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSample(t *testing.T) {
+	// A deterministic test of the sampler logic, ported from the tracing
+	// client's TestSample: feed a fixed time/draw sequence and assert the
+	// resulting admit count.
+	type testCase struct {
+		rate   float64
+		maxqps float64
+		want   int
+	}
+	const delta = 25 * time.Millisecond
+	for _, test := range []testCase{
+		// qps won't matter, so we will sample half of the 80 calls
+		{0.50, 100, 40},
+		// with 1 qps and a burst of 2, we will sample twice in second #1,
+		// once in the partial second #2
+		{0.50, 1, 3},
+	} {
+		sp, err := NewLimitedSampler(test.rate, test.maxqps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := sp.(*sampler)
+
+		sampled := 0
+		tm := time.Now()
+		for i := 0; i < 80; i++ {
+			if s.sample(tm, float64(i%2)) {
+				sampled++
+			}
+			tm = tm.Add(delta)
+		}
+		if sampled != test.want {
+			t.Errorf("rate=%f, maxqps=%f: got %d samples, want %d", test.rate, test.maxqps, sampled, test.want)
+		}
+	}
+}
+
+// TestSampleTokenBurstCap asserts that tokens accumulated during an idle
+// period are capped at maxBurst instead of growing without bound, so a
+// sampler that's been quiet for a long time can't admit an unbounded burst
+// once events resume.
+func TestSampleTokenBurstCap(t *testing.T) {
+	sp, err := NewLimitedSampler(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sp.(*sampler)
+
+	tm := time.Now()
+	// Prime lastTick without consuming a token, then sit idle long enough
+	// to refill far more than maxBurst tokens were they not capped.
+	s.sample(tm, 1)
+	tm = tm.Add(time.Hour)
+
+	admitted := 0
+	for i := 0; i < maxBurst+1; i++ {
+		if s.sample(tm, 0) {
+			admitted++
+		}
+	}
+	if admitted != maxBurst {
+		t.Errorf("got %d calls admitted right after an idle period, want %d (maxBurst)", admitted, maxBurst)
+	}
+
+	if s.sample(tm, 0) {
+		t.Error("sample admitted a call beyond the refilled token cap")
+	}
+}
@@ -0,0 +1,61 @@
+// Package metrics exposes the Prometheus collectors kube-parrot's
+// controllers instrument themselves with, plus a handler to serve them.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// RoutesAdded counts BGP routes announced by reconcile loops.
+	RoutesAdded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "kube_parrot",
+		Subsystem: "controller",
+		Name:      "routes_added_total",
+		Help:      "Total number of BGP routes added by reconcile loops.",
+	})
+
+	// RoutesWithdrawn counts BGP routes withdrawn by reconcile loops.
+	RoutesWithdrawn = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "kube_parrot",
+		Subsystem: "controller",
+		Name:      "routes_withdrawn_total",
+		Help:      "Total number of BGP routes withdrawn by reconcile loops.",
+	})
+
+	// ReconcileDuration observes how long a single reconcile cycle takes.
+	ReconcileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "kube_parrot",
+		Subsystem: "controller",
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of ExternalServicesController reconcile cycles.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// DirtyQueueDepth tracks how many Dirty() events have been observed
+	// since the last reconcile cycle drained them.
+	DirtyQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "kube_parrot",
+		Subsystem: "controller",
+		Name:      "dirty_queue_depth",
+		Help:      "Number of Dirty() events observed since the last reconcile cycle.",
+	})
+
+	// BGPSendErrors counts failed route add/delete operations.
+	BGPSendErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "kube_parrot",
+		Subsystem: "controller",
+		Name:      "bgp_send_errors_total",
+		Help:      "Total number of errors returned by BGP route add/delete operations.",
+	})
+)
+
+// Handler returns an http.Handler serving the registered collectors in the
+// Prometheus exposition format. Callers mount it at /metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
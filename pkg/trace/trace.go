@@ -0,0 +1,48 @@
+// Package trace configures OpenTelemetry tracing for kube-parrot's
+// controllers and exposes the tracer they instrument their reconcile loops
+// with.
+package trace
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/sapcc/kube-parrot/pkg/controller"
+
+// Init configures the global TracerProvider to export spans to the
+// OTLP/HTTP collector at endpoint (e.g. "otel-collector:4318"). It returns
+// a shutdown func that must be called to flush pending spans on exit. If
+// endpoint is empty, tracing stays disabled and Tracer() returns a no-op
+// tracer.
+func Init(ctx context.Context, endpoint, serviceName string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer kube-parrot controllers use to create reconcile
+// spans. It always returns a usable tracer, backed by a no-op implementation
+// until Init has configured a real exporter.
+func Tracer() oteltrace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"strconv"
+
+	"github.com/sapcc/kube-parrot/pkg/types"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+)
+
+// ServiceExternalIPs returns the IPs that should be announced via BGP for
+// service: its ExternalIPs unconditionally, plus — for Type: LoadBalancer
+// services that opt in via the types.AnnotationBGPAnnouncement annotation —
+// its LoadBalancerIP.
+//
+// Status.LoadBalancer.Ingress is deliberately not included here:
+// LoadBalancerServicesController derives the Ingress it writes back from
+// this very function, so folding Ingress into the announce decision would
+// make announcement depend on a status field that only gets set once the
+// service is already announced, and a service with neither ExternalIPs nor
+// a LoadBalancerIP could never bootstrap.
+//
+// Known limitation: this means a Type: LoadBalancer service relying on an
+// external controller (a cloud provider, MetalLB, ...) to populate
+// Status.LoadBalancer.Ingress itself -- the common case when it has
+// neither ExternalIPs nor Spec.LoadBalancerIP set -- announces nothing
+// here and stays <pending> forever under kube-parrot. kube-parrot only
+// supports the case where it is itself the thing assigning the IP.
+func ServiceExternalIPs(service *v1.Service) []string {
+	ips := append([]string{}, service.Spec.ExternalIPs...)
+
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return ips
+	}
+
+	announce, _ := strconv.ParseBool(service.Annotations[types.AnnotationBGPAnnouncement])
+	if !announce {
+		return ips
+	}
+
+	if service.Spec.LoadBalancerIP != "" {
+		ips = append(ips, service.Spec.LoadBalancerIP)
+	}
+
+	return ips
+}